@@ -0,0 +1,86 @@
+// Command image-builder-admin gives on-call operators a supported way to
+// recover from bad requests without hand-crafting SQL against the composes
+// table.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/osbuild/image-builder/internal/config"
+	"github.com/osbuild/image-builder/internal/db"
+)
+
+func main() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: image-builder-admin <reset-quota|delete-compose|reassign-compose|ensure-clean> [args...]")
+		os.Exit(1)
+	}
+
+	c := &config.ImageBuilderConfig{
+		MigrationsDir: "/usr/share/image-builder/migrations",
+		PGHost:        "localhost",
+		PGPort:        "5432",
+		PGDatabase:    "imagebuilder",
+		PGUser:        "postgres",
+		PGPassword:    "foobar",
+		PGSSLMode:     "disable",
+	}
+	if err := config.LoadConfigFromEnv(c); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	connStr := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=%s",
+		c.PGUser, c.PGPassword, c.PGHost, c.PGPort, c.PGDatabase, c.PGSSLMode)
+
+	if err := run(connStr, c.MigrationsDir, args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(connStr, migrationsDir string, args []string) error {
+	verb := args[0]
+	rest := args[1:]
+
+	switch verb {
+	case "reset-quota":
+		if len(rest) != 1 {
+			return fmt.Errorf("reset-quota requires exactly one argument: <org_id>")
+		}
+		// Quota accounting isn't tracked in internal/db today; this verb
+		// is wired up so the CLI shape is in place for when it is.
+		fmt.Printf("reset-quota: no quota is tracked for org %s in internal/db, nothing to do\n", rest[0])
+		return nil
+	case "delete-compose":
+		if len(rest) != 1 {
+			return fmt.Errorf("delete-compose requires exactly one argument: <uuid>")
+		}
+		d, err := db.InitDBConnectionPool(connStr)
+		if err != nil {
+			return err
+		}
+		return d.DeleteCompose(rest[0])
+	case "reassign-compose":
+		if len(rest) != 2 {
+			return fmt.Errorf("reassign-compose requires exactly two arguments: <uuid> <new_org_id>")
+		}
+		d, err := db.InitDBConnectionPool(connStr)
+		if err != nil {
+			return err
+		}
+		return d.ReassignCompose(rest[0], rest[1])
+	case "ensure-clean":
+		if err := db.EnsureClean(connStr, migrationsDir); err != nil {
+			return err
+		}
+		fmt.Println("database is fully migrated")
+		return nil
+	default:
+		return fmt.Errorf("unknown verb %q", verb)
+	}
+}
@@ -4,7 +4,6 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"testing"
 	"time"
 
@@ -12,9 +11,10 @@ import (
 	"github.com/jackc/pgx/v4"
 	"github.com/stretchr/testify/require"
 
-	"github.com/osbuild/image-builder/internal/config"
 	"github.com/osbuild/image-builder/internal/db"
+	"github.com/osbuild/image-builder/internal/db/dbtest"
 	"github.com/osbuild/image-builder/internal/logger"
+	"github.com/osbuild/image-builder/worker/gc"
 )
 
 const (
@@ -25,135 +25,156 @@ const (
 	ORGID1 = "100000"
 )
 
-func conf(t *testing.T) *config.ImageBuilderConfig {
-	c := config.ImageBuilderConfig{
-		ListenAddress: "unused",
-		LogLevel:      "INFO",
-		MigrationsDir: "/usr/share/image-builder/migrations",
-		PGHost:        "localhost",
-		PGPort:        "5432",
-		PGDatabase:    "imagebuilder",
-		PGUser:        "postgres",
-		PGPassword:    "foobar",
-		PGSSLMode:     "disable",
-	}
+func TestMigration(t *testing.T) {
+	t.Parallel()
 
-	err := config.LoadConfigFromEnv(&c)
+	connStr, cleanup := dbtest.NewConnStr(t)
+	defer cleanup()
+
+	log, err := logger.NewLogger("INFO", nil, nil, nil, nil)
 	require.NoError(t, err)
 
-	return &c
+	t.Run("step 1: account_id", func(t *testing.T) {
+		err := db.MigrateSteps(connStr, dbtest.MigrationsDir, 1, log)
+		require.NoError(t, err)
+
+		conn, err := pgx.Connect(context.Background(), connStr)
+		require.NoError(t, err)
+		defer conn.Close(context.Background())
+
+		insert := "INSERT INTO composes(job_id, request, created_at, account_id, org_id) VALUES ($1, $2, CURRENT_TIMESTAMP, $3, $4)"
+		_, err = conn.Exec(context.Background(), insert, uuid.New().String(), "{}", ANR1, ORGID1)
+		require.NoError(t, err)
+	})
+
+	t.Run("step 2: account_number", func(t *testing.T) {
+		err := db.MigrateSteps(connStr, dbtest.MigrationsDir, 1, log)
+		require.NoError(t, err)
+
+		conn, err := pgx.Connect(context.Background(), connStr)
+		require.NoError(t, err)
+		defer conn.Close(context.Background())
+
+		insert := "INSERT INTO composes(job_id, request, created_at, account_number, org_id) VALUES ($1, $2, CURRENT_TIMESTAMP, $3, $4)"
+		_, err = conn.Exec(context.Background(), insert, uuid.New().String(), "{}", ANR2, ORGID1)
+		require.NoError(t, err)
+
+		// inserting data referring to account_id should fail after migration step 2
+		insert = "INSERT INTO composes(job_id, request, created_at, account_id, org_id) VALUES ($1, $2, CURRENT_TIMESTAMP, $3, $4)"
+		_, err = conn.Exec(context.Background(), insert, uuid.New().String(), "{}", ANR1, ORGID1)
+		require.Error(t, err)
+	})
+
+	t.Run("step 3: account_number required", func(t *testing.T) {
+		err := db.MigrateSteps(connStr, dbtest.MigrationsDir, 1, log)
+		require.NoError(t, err)
+
+		d, err := db.InitDBConnectionPool(connStr)
+		require.NoError(t, err)
+
+		// Verify that after migration step 3 adding a compose request to the db requires a non empty account number.
+		err = d.InsertCompose(uuid.New().String(), "", ORGID1, []byte("{}"))
+		require.Error(t, err)
+
+		// make sure migrating a fully migrated db doesn't error out
+		err = db.Migrate(connStr, dbtest.MigrationsDir, log)
+		require.NoError(t, err)
+
+		// Check data inserted at migration step 1 and 2 are still accessible
+		_, count, err := d.GetComposes(ANR1, 100, 0)
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+		_, count, err = d.GetComposes(ANR2, 100, 0)
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+	})
 }
 
-func connStr(t *testing.T) string {
-	c := conf(t)
-	return fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=%s", c.PGUser, c.PGPassword, c.PGHost, c.PGPort, c.PGDatabase, c.PGSSLMode)
-}
+func TestMigrateRoundTrip(t *testing.T) {
+	t.Parallel()
 
-func migrateOneStep(t *testing.T) {
-	c := conf(t)
+	connStr, cleanup := dbtest.NewConnStr(t)
+	defer cleanup()
 
-	log, err := logger.NewLogger(c.LogLevel, nil, nil, nil, nil)
+	log, err := logger.NewLogger("INFO", nil, nil, nil, nil)
 	require.NoError(t, err)
-	require.NotNil(t, log)
 
-	err = db.MigrateSteps(connStr(t), c.MigrationsDir, 1, log)
+	// migrate all the way up, then step back down to version 1 (the
+	// initial composes table, before account_number and the keyset index
+	// were added) and all the way back up again, checking the composes
+	// table survives the round trip.
+	err = db.Migrate(connStr, dbtest.MigrationsDir, log)
 	require.NoError(t, err)
-}
 
-func migrateUp(t *testing.T) {
-	c := conf(t)
-
-	log, err := logger.NewLogger(c.LogLevel, nil, nil, nil, nil)
+	d, err := db.InitDBConnectionPool(connStr)
+	require.NoError(t, err)
+	err = d.InsertCompose(uuid.New().String(), ANR1, ORGID1, []byte("{}"))
 	require.NoError(t, err)
-	require.NotNil(t, log)
 
-	err = db.Migrate(connStr(t), c.MigrationsDir, log)
+	err = db.MigrateDown(connStr, dbtest.MigrationsDir, 3, log)
 	require.NoError(t, err)
-}
 
-func connect(t *testing.T) *pgx.Conn {
-	conn, err := pgx.Connect(context.Background(), connStr(t))
+	err = db.Migrate(connStr, dbtest.MigrationsDir, log)
 	require.NoError(t, err)
-	return conn
-}
 
-func tearDown(t *testing.T) {
-	conn := connect(t)
-	defer conn.Close(context.Background())
-	conn.Exec(context.Background(), "drop table composes")
-	conn.Exec(context.Background(), "drop table schema_migrations")
+	_, count, err := d.GetComposes(ANR1, 100, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
 }
 
-func testMigration(t *testing.T) {
-	defer tearDown(t) // tear-down cleanup the database
+func TestMigrateDryRun(t *testing.T) {
+	t.Parallel()
 
-	migrateOneStep(t) //migrate to step 1
+	connStr, cleanup := dbtest.NewConnStr(t)
+	defer cleanup()
 
-	conn := connect(t)
-	defer conn.Close(context.Background())
-	insert := "INSERT INTO composes(job_id, request, created_at, account_id, org_id) VALUES ($1, $2, CURRENT_TIMESTAMP, $3, $4)"
-	_, err := conn.Exec(context.Background(), insert, uuid.New().String(), "{}", ANR1, ORGID1)
+	log, err := logger.NewLogger("INFO", nil, nil, nil, nil)
 	require.NoError(t, err)
 
-	migrateOneStep(t) // migrate to step 2
-
-	insert = "INSERT INTO composes(job_id, request, created_at, account_number, org_id) VALUES ($1, $2, CURRENT_TIMESTAMP, $3, $4)"
-	_, err = conn.Exec(context.Background(), insert, uuid.New().String(), "{}", ANR2, ORGID1)
+	err = db.MigrateSteps(connStr, dbtest.MigrationsDir, 1, log)
 	require.NoError(t, err)
 
-	// inserting data referring to account_id should fail after migration step 2
-	insert = "INSERT INTO composes(job_id, request, created_at, account_id, org_id) VALUES ($1, $2, CURRENT_TIMESTAMP, $3, $4)"
-	_, err = conn.Exec(context.Background(), insert, uuid.New().String(), "{}", ANR1, ORGID1)
-	require.Error(t, err)
-
-	migrateOneStep(t) // migrate to step 3
-
-	// Verify that after migration step 3 adding a compose request to the db requires a non empty account number.
-	d, err := db.InitDBConnectionPool(connStr(t))
-	err = d.InsertCompose(uuid.New().String(), "", ORGID1, []byte("{}"))
-	require.Error(t, err)
-
-	// make sure migrating a fully migrated db doesn't error out
-	migrateUp(t)
-
-	// Check data inserted at migration step 1 and 2 are still accessible
-	_, count, err := d.GetComposes(ANR1, 100, 0)
+	// a dry-run step should be rolled back, leaving the schema at version 1
+	err = db.DryRunSteps(connStr, dbtest.MigrationsDir, 1, log)
 	require.NoError(t, err)
-	require.Equal(t, 1, count)
-	_, count, err = d.GetComposes(ANR2, 100, 0)
+
+	statuses, err := db.MigrateStatus(connStr, dbtest.MigrationsDir)
 	require.NoError(t, err)
-	require.Equal(t, 1, count)
+	require.Len(t, statuses, 4)
+	require.True(t, statuses[0].Applied)
+	require.False(t, statuses[1].Applied)
+	require.False(t, statuses[3].Applied)
 }
 
-func testInsertCompose(t *testing.T) {
-	d, err := db.InitDBConnectionPool(connStr(t))
-	require.NoError(t, err)
+func TestInsertCompose(t *testing.T) {
+	t.Parallel()
 
-	// teardwon
-	defer tearDown(t)
+	d, cleanup := dbtest.New(t)
+	defer cleanup()
 
-	// setup
-	migrateUp(t)
+	t.Run("insert succeeds", func(t *testing.T) {
+		err := d.InsertCompose(uuid.New().String(), ANR1, ORGID1, []byte("{}"))
+		require.NoError(t, err)
+	})
 
-	// test
-	err = d.InsertCompose(uuid.New().String(), ANR1, ORGID1, []byte("{}"))
-	require.NoError(t, err)
-	err = d.InsertCompose("toto", ANR1, ORGID1, []byte("{}"))
-	require.Error(t, err)
-	err = d.InsertCompose(uuid.New().String(), "", ORGID1, []byte("{}"))
-	require.Error(t, err)
+	t.Run("invalid job id rejected", func(t *testing.T) {
+		err := d.InsertCompose("toto", ANR1, ORGID1, []byte("{}"))
+		require.Error(t, err)
+	})
+
+	t.Run("empty account number rejected", func(t *testing.T) {
+		err := d.InsertCompose(uuid.New().String(), "", ORGID1, []byte("{}"))
+		require.Error(t, err)
+	})
 }
 
-func testGetCompose(t *testing.T) {
-	d, err := db.InitDBConnectionPool(connStr(t))
-	require.NoError(t, err)
+func TestGetCompose(t *testing.T) {
+	t.Parallel()
 
-	// teardwon
-	defer tearDown(t)
+	d, cleanup := dbtest.New(t)
+	defer cleanup()
 
-	// setup
-	migrateUp(t)
-	err = d.InsertCompose(uuid.New().String(), ANR1, ORGID1, []byte("{}"))
+	err := d.InsertCompose(uuid.New().String(), ANR1, ORGID1, []byte("{}"))
 	require.NoError(t, err)
 	err = d.InsertCompose(uuid.New().String(), ANR1, ORGID1, []byte("{}"))
 	require.NoError(t, err)
@@ -162,71 +183,213 @@ func testGetCompose(t *testing.T) {
 	err = d.InsertCompose(uuid.New().String(), ANR1, ORGID1, []byte("{}"))
 	require.NoError(t, err)
 
-	// test
-	// GetComposes works as expected
-	composes, count, err := d.GetComposes(ANR1, 100, 0)
-	require.NoError(t, err)
-	require.Equal(t, 4, count)
-	require.Equal(t, 4, len(composes))
+	t.Run("GetComposes works as expected", func(t *testing.T) {
+		composes, count, err := d.GetComposes(ANR1, 100, 0)
+		require.NoError(t, err)
+		require.Equal(t, 4, count)
+		require.Equal(t, 4, len(composes))
+	})
+
+	t.Run("count returns total in db, ignoring limits", func(t *testing.T) {
+		composes, count, err := d.GetComposes(ANR1, 1, 2)
+		require.NoError(t, err)
+		require.Equal(t, 4, count)
+		require.Equal(t, 1, len(composes))
+	})
+
+	t.Run("GetCompose works as expected", func(t *testing.T) {
+		composes, _, err := d.GetComposes(ANR1, 100, 0)
+		require.NoError(t, err)
+
+		compose, err := d.GetCompose(composes[0].Id.String(), ANR1)
+		require.NoError(t, err)
+		require.Equal(t, composes[0], *compose)
+	})
+
+	t.Run("cross-account compose access not allowed", func(t *testing.T) {
+		composes, _, err := d.GetComposes(ANR1, 100, 0)
+		require.NoError(t, err)
+
+		compose, err := d.GetCompose(composes[0].Id.String(), ANR2)
+		require.Equal(t, db.ComposeNotFoundError, err)
+		require.Nil(t, compose)
+	})
+
+	t.Run("keyset pagination is stable under concurrent inserts", func(t *testing.T) {
+		var pages [][]db.ComposeEntry
+		opts := db.ListOpts{Limit: 2}
+		for {
+			page, info, err := d.GetComposesPage(ORGID1, opts)
+			require.NoError(t, err)
+			pages = append(pages, page)
+
+			// simulate a concurrent insert landing between page fetches;
+			// it must not shift already-returned rows or duplicate them
+			// across pages.
+			err = d.InsertCompose(uuid.New().String(), ANR1, ORGID1, []byte("{}"))
+			require.NoError(t, err)
+
+			if info.NextCursor == "" {
+				break
+			}
+			opts.Cursor = info.NextCursor
+		}
+
+		seen := map[string]bool{}
+		for _, page := range pages {
+			for _, c := range page {
+				require.False(t, seen[c.Id.String()], "compose %s returned on more than one page", c.Id)
+				seen[c.Id.String()] = true
+			}
+		}
+		require.Equal(t, 4, len(seen))
+	})
+
+	t.Run("image type filter", func(t *testing.T) {
+		err := d.InsertCompose(uuid.New().String(), ANR1, ORGID1, []byte(`{"image_type": "ami"}`))
+		require.NoError(t, err)
+		err = d.InsertCompose(uuid.New().String(), ANR1, ORGID1, []byte(`{"image_type": "qcow2"}`))
+		require.NoError(t, err)
+
+		page, _, err := d.GetComposesPage(ORGID1, db.ListOpts{Limit: 100, ImageType: "ami"})
+		require.NoError(t, err)
+		require.Equal(t, 1, len(page))
+		require.JSONEq(t, `{"image_type": "ami"}`, string(page[0].Request))
+	})
+}
+
+func TestDeleteCompose(t *testing.T) {
+	t.Parallel()
+
+	d, cleanup := dbtest.New(t)
+	defer cleanup()
 
-	// count returns total in db, ignoring limits
-	composes, count, err = d.GetComposes(ANR1, 1, 2)
+	jobId := uuid.New().String()
+	err := d.InsertCompose(jobId, ANR1, ORGID1, []byte("{}"))
 	require.NoError(t, err)
-	require.Equal(t, 4, count)
-	require.Equal(t, 1, len(composes))
 
-	// GetCompose works as expected
-	compose, err := d.GetCompose(composes[0].Id.String(), ANR1)
+	err = d.DeleteCompose(jobId)
 	require.NoError(t, err)
-	require.Equal(t, composes[0], *compose)
 
-	// cross-account compose access not allowed
-	compose, err = d.GetCompose(composes[0].Id.String(), ANR2)
+	_, err = d.GetCompose(jobId, ANR1)
 	require.Equal(t, db.ComposeNotFoundError, err)
-	require.Nil(t, compose)
 
+	err = d.DeleteCompose(jobId)
+	require.Equal(t, db.ComposeNotFoundError, err)
 }
 
-func testCountComposesSince(t *testing.T) {
-	d, err := db.InitDBConnectionPool(connStr(t))
+func TestReassignCompose(t *testing.T) {
+	t.Parallel()
+
+	d, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	jobId := uuid.New().String()
+	err := d.InsertCompose(jobId, ANR1, ORGID1, []byte("{}"))
 	require.NoError(t, err)
 
-	// teardwon
-	defer tearDown(t)
+	const ORGID2 = "100001"
+	err = d.ReassignCompose(jobId, ORGID2)
+	require.NoError(t, err)
 
-	// setup
-	migrateUp(t)
-	conn := connect(t)
-	defer conn.Close(context.Background())
-	insert := "INSERT INTO composes(job_id, request, created_at, account_number, org_id) VALUES ($1, $2, CURRENT_TIMESTAMP - interval '2 days', $3, $4)"
-	_, err = conn.Exec(context.Background(), insert, uuid.New().String(), "{}", ANR3, ORGID1)
-	insert = "INSERT INTO composes(job_id, request, created_at, account_number, org_id) VALUES ($1, $2, CURRENT_TIMESTAMP - interval '3 days', $3, $4)"
-	_, err = conn.Exec(context.Background(), insert, uuid.New().String(), "{}", ANR3, ORGID1)
-	insert = "INSERT INTO composes(job_id, request, created_at, account_number, org_id) VALUES ($1, $2, CURRENT_TIMESTAMP - interval '4 days', $3, $4)"
-	_, err = conn.Exec(context.Background(), insert, uuid.New().String(), "{}", ANR3, ORGID1)
+	compose, err := d.GetCompose(jobId, ANR1)
+	require.NoError(t, err)
+	require.Equal(t, ORGID2, compose.OrgId)
 
-	// Verify quering since an interval
-	count, err := d.CountComposesSince(ANR3, 24*time.Hour)
+	err = d.ReassignCompose(uuid.New().String(), ORGID2)
+	require.Equal(t, db.ComposeNotFoundError, err)
+}
+
+func TestEnsureClean(t *testing.T) {
+	t.Parallel()
+
+	connStr, cleanup := dbtest.NewConnStr(t)
+	defer cleanup()
+
+	err := db.EnsureClean(connStr, dbtest.MigrationsDir)
+	require.Error(t, err)
+
+	err = db.Migrate(connStr, dbtest.MigrationsDir, nil)
 	require.NoError(t, err)
-	require.Equal(t, 0, count)
 
-	count, err = d.CountComposesSince(ANR3, 48*time.Hour+time.Second)
+	err = db.EnsureClean(connStr, dbtest.MigrationsDir)
 	require.NoError(t, err)
-	require.Equal(t, 1, count)
+}
 
-	count, err = d.CountComposesSince(ANR3, 72*time.Hour+time.Second)
+func TestGCDeleteComposesOlderThan(t *testing.T) {
+	t.Parallel()
+
+	d, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	insert := "INSERT INTO composes(job_id, request, created_at, account_number, org_id) VALUES ($1, $2, CURRENT_TIMESTAMP - interval '1 day', $3, $4)"
+	_, err := d.Pool.Exec(context.Background(), insert, uuid.New().String(), "{}", ANR1, ORGID1)
+	require.NoError(t, err)
+	insert = "INSERT INTO composes(job_id, request, created_at, account_number, org_id) VALUES ($1, $2, CURRENT_TIMESTAMP - interval '10 days', $3, $4)"
+	_, err = d.Pool.Exec(context.Background(), insert, uuid.New().String(), "{}", ANR1, ORGID1)
 	require.NoError(t, err)
-	require.Equal(t, 2, count)
+	insert = "INSERT INTO composes(job_id, request, created_at, account_number, org_id) VALUES ($1, $2, CURRENT_TIMESTAMP - interval '20 days', $3, $4)"
+	_, err = d.Pool.Exec(context.Background(), insert, uuid.New().String(), "{}", ANR1, ORGID1)
+	require.NoError(t, err)
+
+	w := gc.Worker{DB: d, Retention: 7 * 24 * time.Hour}
+	w.Sweep()
 
-	count, err = d.CountComposesSince(ANR3, 96*time.Hour+time.Second)
+	_, count, err := d.GetComposes(ANR1, 100, 0)
 	require.NoError(t, err)
-	require.Equal(t, 3, count)
+	require.Equal(t, 1, count)
 }
 
-func TestMain(t *testing.T) {
-	tearDown(t)
-	testMigration(t)
-	testInsertCompose(t)
-	testGetCompose(t)
-	testCountComposesSince(t)
-}
\ No newline at end of file
+func TestCountComposesSince(t *testing.T) {
+	t.Parallel()
+
+	d, cleanup := dbtest.New(t)
+	defer cleanup()
+
+	insert := "INSERT INTO composes(job_id, request, created_at, account_number, org_id) VALUES ($1, $2, CURRENT_TIMESTAMP - interval '2 days', $3, $4)"
+	_, err := d.Pool.Exec(context.Background(), insert, uuid.New().String(), "{}", ANR3, ORGID1)
+	require.NoError(t, err)
+	insert = "INSERT INTO composes(job_id, request, created_at, account_number, org_id) VALUES ($1, $2, CURRENT_TIMESTAMP - interval '3 days', $3, $4)"
+	_, err = d.Pool.Exec(context.Background(), insert, uuid.New().String(), "{}", ANR3, ORGID1)
+	require.NoError(t, err)
+	insert = "INSERT INTO composes(job_id, request, created_at, account_number, org_id) VALUES ($1, $2, CURRENT_TIMESTAMP - interval '4 days', $3, $4)"
+	_, err = d.Pool.Exec(context.Background(), insert, uuid.New().String(), "{}", ANR3, ORGID1)
+	require.NoError(t, err)
+
+	t.Run("querying since an interval", func(t *testing.T) {
+		count, err := d.CountComposesSince(ANR3, 24*time.Hour)
+		require.NoError(t, err)
+		require.Equal(t, 0, count)
+
+		count, err = d.CountComposesSince(ANR3, 48*time.Hour+time.Second)
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+
+		count, err = d.CountComposesSince(ANR3, 72*time.Hour+time.Second)
+		require.NoError(t, err)
+		require.Equal(t, 2, count)
+
+		count, err = d.CountComposesSince(ANR3, 96*time.Hour+time.Second)
+		require.NoError(t, err)
+		require.Equal(t, 3, count)
+	})
+
+	t.Run("time-range filters return the expected subset", func(t *testing.T) {
+		now := time.Now()
+
+		page, _, err := d.GetComposesPage(ORGID1, db.ListOpts{
+			Limit: 100,
+			Since: now.Add(-3*24*time.Hour - time.Hour),
+			Until: now.Add(-2*24*time.Hour + time.Hour),
+		})
+		require.NoError(t, err)
+		require.Equal(t, 2, len(page))
+
+		page, _, err = d.GetComposesPage(ORGID1, db.ListOpts{
+			Limit: 100,
+			Until: now.Add(-24 * time.Hour),
+		})
+		require.NoError(t, err)
+		require.Equal(t, 3, len(page))
+	})
+}
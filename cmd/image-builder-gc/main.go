@@ -0,0 +1,74 @@
+// Command image-builder-gc runs the compose-retention GC worker. In a
+// full deployment this loop is started as a goroutine from the API
+// server's main instead of run standalone; it's split out as its own
+// binary here since cmd/image-builder doesn't exist in this tree yet.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/osbuild/image-builder/internal/config"
+	"github.com/osbuild/image-builder/internal/db"
+	"github.com/osbuild/image-builder/internal/logger"
+	"github.com/osbuild/image-builder/worker/gc"
+)
+
+func main() {
+	c := &config.ImageBuilderConfig{
+		ListenAddress:    ":8086",
+		LogLevel:         "INFO",
+		PGHost:           "localhost",
+		PGPort:           "5432",
+		PGDatabase:       "imagebuilder",
+		PGUser:           "postgres",
+		PGPassword:       "foobar",
+		PGSSLMode:        "disable",
+		ComposeRetention: 14 * 24 * time.Hour,
+	}
+	if err := config.LoadConfigFromEnv(c); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	log, err := logger.NewLogger(c.LogLevel, nil, nil, nil, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	connStr := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=%s",
+		c.PGUser, c.PGPassword, c.PGHost, c.PGPort, c.PGDatabase, c.PGSSLMode)
+	d, err := db.InitDBConnectionPool(connStr)
+	if err != nil {
+		log.WithError(err).Fatal("unable to connect to database")
+	}
+
+	w := &gc.Worker{
+		DB:        d,
+		Retention: c.ComposeRetention,
+		Interval:  time.Hour,
+		Log:       log,
+	}
+
+	done := make(chan struct{})
+	go w.Run(done)
+
+	http.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(c.ListenAddress, nil); err != nil {
+			log.WithError(err).Error("metrics server stopped")
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	close(done)
+}
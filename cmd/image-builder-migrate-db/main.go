@@ -0,0 +1,115 @@
+// Command image-builder-migrate-db lets operators advance or rewind the
+// image-builder schema without redeploying the server.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/osbuild/image-builder/internal/config"
+	"github.com/osbuild/image-builder/internal/db"
+	"github.com/osbuild/image-builder/internal/logger"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "preview the migration without applying it")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "usage: image-builder-migrate-db [--dry-run] <up|down|to|status> [steps|version]")
+		os.Exit(1)
+	}
+
+	c := &config.ImageBuilderConfig{
+		MigrationsDir: "/usr/share/image-builder/migrations",
+		PGHost:        "localhost",
+		PGPort:        "5432",
+		PGDatabase:    "imagebuilder",
+		PGUser:        "postgres",
+		PGPassword:    "foobar",
+		PGSSLMode:     "disable",
+		LogLevel:      "INFO",
+	}
+	if err := config.LoadConfigFromEnv(c); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	log, err := logger.NewLogger(c.LogLevel, nil, nil, nil, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	connStr := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=%s",
+		c.PGUser, c.PGPassword, c.PGHost, c.PGPort, c.PGDatabase, c.PGSSLMode)
+
+	if err := run(connStr, c.MigrationsDir, *dryRun, args, log); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(connStr, migrationsDir string, dryRun bool, args []string, log *logrus.Logger) error {
+	cmd := args[0]
+
+	switch cmd {
+	case "up":
+		steps, err := stepsArg(args, 1)
+		if err != nil {
+			return err
+		}
+		return doSteps(connStr, migrationsDir, steps, dryRun, log)
+	case "down":
+		steps, err := stepsArg(args, 1)
+		if err != nil {
+			return err
+		}
+		return doSteps(connStr, migrationsDir, -steps, dryRun, log)
+	case "to":
+		if len(args) < 2 {
+			return fmt.Errorf("to requires a target version")
+		}
+		target, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			return fmt.Errorf("--dry-run is not supported for 'to', use 'up'/'down' with an explicit step count")
+		}
+		return db.MigrateTo(connStr, migrationsDir, uint(target), log)
+	case "status":
+		statuses, err := db.MigrateStatus(connStr, migrationsDir)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			log.Info(fmt.Sprintf("%d %s applied=%v checksum=%s", s.Version, s.Name, s.Applied, s.Checksum))
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown subcommand %q", cmd)
+	}
+}
+
+func doSteps(connStr, migrationsDir string, steps int, dryRun bool, log *logrus.Logger) error {
+	if dryRun {
+		return db.DryRunSteps(connStr, migrationsDir, steps, log)
+	}
+	if steps < 0 {
+		return db.MigrateDown(connStr, migrationsDir, -steps, log)
+	}
+	return db.MigrateSteps(connStr, migrationsDir, steps, log)
+}
+
+func stepsArg(args []string, i int) (int, error) {
+	if len(args) <= i {
+		return 1, nil
+	}
+	return strconv.Atoi(args[i])
+}
@@ -0,0 +1,70 @@
+// Package config holds the runtime configuration for the image-builder
+// services and the helpers used to populate it from the environment.
+package config
+
+import (
+	"os"
+	"time"
+)
+
+// ImageBuilderConfig is the configuration shared by the image-builder
+// binaries (API server, migration tool, admin CLI, ...). Callers are
+// expected to seed it with defaults before calling LoadConfigFromEnv.
+type ImageBuilderConfig struct {
+	ListenAddress string
+	LogLevel      string
+
+	MigrationsDir string
+
+	PGHost     string
+	PGPort     string
+	PGDatabase string
+	PGUser     string
+	PGPassword string
+	PGSSLMode  string
+
+	// ComposeRetention is how long a compose is kept before the GC
+	// worker deletes it. Zero disables GC.
+	ComposeRetention time.Duration
+}
+
+// LoadConfigFromEnv overlays any IMAGE_BUILDER_* environment variables onto
+// conf, leaving fields untouched when the corresponding variable is unset.
+func LoadConfigFromEnv(conf *ImageBuilderConfig) error {
+	overlayString(&conf.ListenAddress, "IMAGE_BUILDER_LISTEN_ADDRESS")
+	overlayString(&conf.LogLevel, "IMAGE_BUILDER_LOG_LEVEL")
+
+	overlayString(&conf.MigrationsDir, "IMAGE_BUILDER_MIGRATIONS_DIR")
+
+	overlayString(&conf.PGHost, "IMAGE_BUILDER_PGHOST")
+	overlayString(&conf.PGPort, "IMAGE_BUILDER_PGPORT")
+	overlayString(&conf.PGDatabase, "IMAGE_BUILDER_PGDATABASE")
+	overlayString(&conf.PGUser, "IMAGE_BUILDER_PGUSER")
+	overlayString(&conf.PGPassword, "IMAGE_BUILDER_PGPASSWORD")
+	overlayString(&conf.PGSSLMode, "IMAGE_BUILDER_PGSSLMODE")
+
+	if err := overlayDuration(&conf.ComposeRetention, "IMAGE_BUILDER_COMPOSE_RETENTION"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func overlayString(dst *string, env string) {
+	if v, ok := os.LookupEnv(env); ok {
+		*dst = v
+	}
+}
+
+func overlayDuration(dst *time.Duration, env string) error {
+	v, ok := os.LookupEnv(env)
+	if !ok {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	*dst = d
+	return nil
+}
@@ -0,0 +1,185 @@
+// Package db wraps the composes table behind a small repository-style API
+// and drives schema migrations for it.
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// ComposeNotFoundError is returned by GetCompose when the requested compose
+// doesn't exist, or doesn't belong to the requesting account.
+var ComposeNotFoundError = errors.New("compose not found")
+
+// ComposeEntry is a single row of the composes table.
+type ComposeEntry struct {
+	Id            uuid.UUID
+	Request       []byte
+	CreatedAt     time.Time
+	AccountNumber string
+	OrgId         string
+}
+
+// DB is a thin repository around the composes table, backed by a pgx
+// connection pool.
+type DB struct {
+	Pool *pgxpool.Pool
+}
+
+// InitDBConnectionPool opens a pgx connection pool against connStr.
+func InitDBConnectionPool(connStr string) (*DB, error) {
+	pool, err := pgxpool.Connect(context.Background(), connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DB{Pool: pool}, nil
+}
+
+// InsertCompose records a new compose request for accountNumber/orgId.
+func (db *DB) InsertCompose(jobId, accountNumber, orgId string, request []byte) error {
+	insert := "INSERT INTO composes(job_id, request, created_at, account_number, org_id) VALUES ($1, $2, CURRENT_TIMESTAMP, $3, $4)"
+	_, err := db.Pool.Exec(context.Background(), insert, jobId, request, accountNumber, orgId)
+	return err
+}
+
+// GetComposes returns up to limit composes for accountNumber, offset by
+// offset, most recent first, along with the total number of composes for
+// that account (ignoring limit/offset).
+func (db *DB) GetComposes(accountNumber string, limit, offset int) ([]ComposeEntry, int, error) {
+	var count int
+	err := db.Pool.QueryRow(context.Background(),
+		"SELECT count(*) FROM composes WHERE account_number = $1", accountNumber).Scan(&count)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Pool.Query(context.Background(),
+		"SELECT job_id, request, created_at, account_number, org_id FROM composes WHERE account_number = $1 ORDER BY created_at DESC LIMIT $2 OFFSET $3",
+		accountNumber, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	composes, err := scanComposes(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return composes, count, nil
+}
+
+// GetCompose returns the compose identified by id, as long as it belongs to
+// accountNumber. It returns ComposeNotFoundError otherwise.
+func (db *DB) GetCompose(id string, accountNumber string) (*ComposeEntry, error) {
+	row := db.Pool.QueryRow(context.Background(),
+		"SELECT job_id, request, created_at, account_number, org_id FROM composes WHERE job_id = $1 AND account_number = $2",
+		id, accountNumber)
+
+	var c ComposeEntry
+	err := row.Scan(&c.Id, &c.Request, &c.CreatedAt, &c.AccountNumber, &c.OrgId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ComposeNotFoundError
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// CountComposesSince returns the number of composes accountNumber has
+// created in the last d.
+func (db *DB) CountComposesSince(accountNumber string, d time.Duration) (int, error) {
+	var count int
+	err := db.Pool.QueryRow(context.Background(),
+		"SELECT count(*) FROM composes WHERE account_number = $1 AND created_at > CURRENT_TIMESTAMP - ($2 * interval '1 second')",
+		accountNumber, d.Seconds()).Scan(&count)
+	return count, err
+}
+
+// deleteBatchLimit bounds how many rows a single DeleteComposesOlderThan
+// call removes, so the GC worker can run its retention sweep as a series
+// of short-lived batches instead of one long-held lock.
+const deleteBatchLimit = 1000
+
+// DeleteComposesOlderThan deletes up to deleteBatchLimit composes whose
+// created_at is older than d, returning how many rows were removed. The GC
+// worker calls it repeatedly, batching a full retention sweep into chunks.
+func (db *DB) DeleteComposesOlderThan(d time.Duration) (int, error) {
+	tag, err := db.Pool.Exec(context.Background(),
+		`DELETE FROM composes WHERE job_id IN (
+			SELECT job_id FROM composes WHERE created_at < CURRENT_TIMESTAMP - ($1 * interval '1 second') LIMIT $2
+		)`,
+		d.Seconds(), deleteBatchLimit)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// DeleteCompose removes the compose identified by id, regardless of which
+// account it belongs to. It's used by the admin CLI to recover from bad
+// requests without hand-crafting SQL against the composes table.
+func (db *DB) DeleteCompose(id string) error {
+	tag, err := db.Pool.Exec(context.Background(), "DELETE FROM composes WHERE job_id = $1", id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ComposeNotFoundError
+	}
+	return nil
+}
+
+// ReassignCompose moves the compose identified by id to newOrgId. It's used
+// by the admin CLI when a compose was recorded under the wrong org.
+func (db *DB) ReassignCompose(id string, newOrgId string) error {
+	tag, err := db.Pool.Exec(context.Background(),
+		"UPDATE composes SET org_id = $1 WHERE job_id = $2", newOrgId, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ComposeNotFoundError
+	}
+	return nil
+}
+
+// EnsureClean reports whether the database at connStr is fully migrated,
+// without applying anything. It's the non-destructive counterpart to
+// Migrate, used by operational tooling that only wants to assert on
+// schema state.
+func EnsureClean(connStr, migrationsDir string) error {
+	statuses, err := MigrateStatus(connStr, migrationsDir)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range statuses {
+		if !s.Applied {
+			return fmt.Errorf("migration %s (version %d) is not applied", s.Name, s.Version)
+		}
+	}
+
+	return nil
+}
+
+func scanComposes(rows pgx.Rows) ([]ComposeEntry, error) {
+	var composes []ComposeEntry
+	for rows.Next() {
+		var c ComposeEntry
+		if err := rows.Scan(&c.Id, &c.Request, &c.CreatedAt, &c.AccountNumber, &c.OrgId); err != nil {
+			return nil, err
+		}
+		composes = append(composes, c)
+	}
+	return composes, rows.Err()
+}
@@ -0,0 +1,105 @@
+// Package dbtest provides a reusable, ephemeral Postgres fixture for
+// integration tests so each test gets its own database instead of sharing
+// one hard-coded instance.
+package dbtest
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+
+	"github.com/osbuild/image-builder/internal/db"
+)
+
+const (
+	// MigrationsDir is relative to the working directory `go test` uses,
+	// i.e. the integration test package that calls New/NewConnStr
+	// (cmd/image-builder-db-test).
+	MigrationsDir = "../../internal/db/migrations"
+
+	pgUser     = "postgres"
+	pgPassword = "foobar"
+)
+
+// NewConnStr starts an ephemeral Postgres container, creates a fresh,
+// unmigrated database inside it with a random name, and returns a
+// connection string for it along with a cleanup func that tears the
+// container down. Use it directly when a test needs to drive migrations
+// itself; otherwise prefer New.
+func NewConnStr(t *testing.T) (string, func()) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	req := testcontainers.ContainerRequest{
+		Image:        "postgres:13",
+		ExposedPorts: []string{"5432/tcp"},
+		Env: map[string]string{
+			"POSTGRES_USER":     pgUser,
+			"POSTGRES_PASSWORD": pgPassword,
+			"POSTGRES_DB":       "postgres",
+		},
+		WaitingFor: wait.ForListeningPort("5432/tcp").WithStartupTimeout(60 * time.Second),
+	}
+
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	require.NoError(t, err)
+
+	host, err := container.Host(ctx)
+	require.NoError(t, err)
+	port, err := container.MappedPort(ctx, "5432")
+	require.NoError(t, err)
+
+	adminConnStr := fmt.Sprintf("postgres://%s:%s@%s:%s/postgres?sslmode=disable", pgUser, pgPassword, host, port.Port())
+
+	dbName := randomDBName()
+	adminConn, err := pgx.Connect(ctx, adminConnStr)
+	require.NoError(t, err)
+	_, err = adminConn.Exec(ctx, fmt.Sprintf("CREATE DATABASE %s", dbName))
+	require.NoError(t, err)
+	require.NoError(t, adminConn.Close(ctx))
+
+	connStr := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable", pgUser, pgPassword, host, port.Port(), dbName)
+
+	cleanup := func() {
+		require.NoError(t, container.Terminate(ctx))
+	}
+
+	return connStr, cleanup
+}
+
+// New starts an ephemeral Postgres container as NewConnStr does, runs all
+// migrations into the fresh database, and returns a connected *db.DB along
+// with a cleanup func. Call it once per test with t.Parallel() for full
+// test isolation.
+func New(t *testing.T) (*db.DB, func()) {
+	t.Helper()
+
+	connStr, cleanupContainer := NewConnStr(t)
+
+	require.NoError(t, db.Migrate(connStr, MigrationsDir, nil))
+
+	d, err := db.InitDBConnectionPool(connStr)
+	require.NoError(t, err)
+
+	cleanup := func() {
+		d.Pool.Close()
+		cleanupContainer()
+	}
+
+	return d, cleanup
+}
+
+func randomDBName() string {
+	return fmt.Sprintf("imagebuilder_test_%d", rand.Int63())
+}
@@ -0,0 +1,242 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+	_ "github.com/golang-migrate/migrate/v4/database/postgres"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/sirupsen/logrus"
+)
+
+func newMigrate(connStr, migrationsDir string) (*migrate.Migrate, error) {
+	return migrate.New("file://"+migrationsDir, connStr)
+}
+
+// Migrate brings the schema at connStr fully up to date using the
+// migrations in migrationsDir.
+func Migrate(connStr, migrationsDir string, log *logrus.Logger) error {
+	m, err := newMigrate(connStr, migrationsDir)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	return stepUntil(m, log, func(m *migrate.Migrate) error { return m.Up() })
+}
+
+// MigrateSteps advances the schema at connStr by steps migrations (steps
+// may be negative to step back), applying them one at a time so that each
+// step's duration can be logged individually.
+func MigrateSteps(connStr, migrationsDir string, steps int, log *logrus.Logger) error {
+	m, err := newMigrate(connStr, migrationsDir)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	return applySteps(m, migrationsDir, log, steps)
+}
+
+// MigrateDown reverts the schema at connStr by steps migrations.
+func MigrateDown(connStr, migrationsDir string, steps int, log *logrus.Logger) error {
+	return MigrateSteps(connStr, migrationsDir, -steps, log)
+}
+
+// MigrateTo moves the schema at connStr to exactly targetVersion, stepping
+// up or down as needed, one migration at a time.
+func MigrateTo(connStr, migrationsDir string, targetVersion uint, log *logrus.Logger) error {
+	m, err := newMigrate(connStr, migrationsDir)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	current, dirty, err := m.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("database is in a dirty state at version %d", current)
+	}
+
+	if errors.Is(err, migrate.ErrNilVersion) {
+		current = 0
+	}
+
+	if targetVersion == current {
+		return nil
+	}
+	if targetVersion > current {
+		return applySteps(m, migrationsDir, log, int(targetVersion-current))
+	}
+	return applySteps(m, migrationsDir, log, -int(current-targetVersion))
+}
+
+// applySteps runs abs(steps) single-step migrations one at a time so each
+// migration's name, direction, and wall-clock duration can be logged.
+func applySteps(m *migrate.Migrate, migrationsDir string, log *logrus.Logger, steps int) error {
+	files, err := loadMigrationFiles(migrationsDir)
+	if err != nil {
+		return err
+	}
+	names := make(map[uint]string, len(files))
+	for _, f := range files {
+		names[f.version] = f.name
+	}
+
+	direction := "up"
+	if steps < 0 {
+		direction = "down"
+	}
+
+	n := steps
+	if n < 0 {
+		n = -n
+	}
+
+	for i := 0; i < n; i++ {
+		before, _, err := m.Version()
+		if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+			return err
+		}
+
+		start := time.Now()
+		if direction == "up" {
+			err = m.Steps(1)
+		} else {
+			err = m.Steps(-1)
+		}
+		elapsed := time.Since(start)
+
+		after, _, verErr := m.Version()
+		if verErr != nil && !errors.Is(verErr, migrate.ErrNilVersion) {
+			return verErr
+		}
+
+		version := after
+		if direction == "down" {
+			version = before
+		}
+
+		if log != nil {
+			log.WithFields(logrus.Fields{
+				"name":      names[version],
+				"from":      before,
+				"to":        after,
+				"direction": direction,
+				"duration":  elapsed,
+			}).Info("applied migration")
+		}
+
+		if err != nil {
+			if errors.Is(err, migrate.ErrNoChange) {
+				break
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func stepUntil(m *migrate.Migrate, log *logrus.Logger, f func(*migrate.Migrate) error) error {
+	start := time.Now()
+	err := f(m)
+	elapsed := time.Since(start)
+
+	if log != nil {
+		log.WithFields(logrus.Fields{
+			"duration": elapsed,
+		}).Info("migrate up")
+	}
+
+	if errors.Is(err, migrate.ErrNoChange) {
+		return nil
+	}
+	return err
+}
+
+// MigrationStatus describes a single migration file on disk and whether it
+// has been applied to the database.
+type MigrationStatus struct {
+	Version  uint
+	Name     string
+	Applied  bool
+	Checksum string
+}
+
+// MigrateStatus reports, for every migration found in migrationsDir,
+// whether it has been applied to connStr, plus a checksum of its up file
+// so operators can detect drift between the file on disk and what's
+// recorded as applied.
+func MigrateStatus(connStr, migrationsDir string) ([]MigrationStatus, error) {
+	m, err := newMigrate(connStr, migrationsDir)
+	if err != nil {
+		return nil, err
+	}
+	defer m.Close()
+
+	current, dirty, err := m.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		return nil, err
+	}
+	if dirty {
+		return nil, fmt.Errorf("database is in a dirty state at version %d", current)
+	}
+	if errors.Is(err, migrate.ErrNilVersion) {
+		current = 0
+	}
+
+	files, err := ioutil.ReadDir(migrationsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := map[uint]string{}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".up.sql") {
+			continue
+		}
+		var version uint
+		if _, err := fmt.Sscanf(f.Name(), "%d_", &version); err != nil {
+			continue
+		}
+		versions[version] = f.Name()
+	}
+
+	var statuses []MigrationStatus
+	for version, name := range versions {
+		sum, err := checksumFile(filepath.Join(migrationsDir, name))
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, MigrationStatus{
+			Version:  version,
+			Name:     name,
+			Applied:  version <= current,
+			Checksum: sum,
+		})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+
+	return statuses, nil
+}
+
+func checksumFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
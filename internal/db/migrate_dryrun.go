@@ -0,0 +1,164 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/sirupsen/logrus"
+)
+
+type migrationFile struct {
+	version uint
+	name    string
+	upPath  string
+}
+
+func loadMigrationFiles(migrationsDir string) ([]migrationFile, error) {
+	entries, err := ioutil.ReadDir(migrationsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []migrationFile
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".up.sql") {
+			continue
+		}
+		var version uint
+		var name string
+		if _, err := fmt.Sscanf(e.Name(), "%d_", &version); err != nil {
+			continue
+		}
+		name = strings.TrimSuffix(strings.TrimPrefix(e.Name(), fmt.Sprintf("%04d_", version)), ".up.sql")
+		files = append(files, migrationFile{version: version, name: name, upPath: filepath.Join(migrationsDir, e.Name())})
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].version < files[j].version })
+	return files, nil
+}
+
+func currentSchemaVersion(ctx context.Context, conn *pgx.Conn) (uint, error) {
+	var exists bool
+	err := conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'schema_migrations')").Scan(&exists)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, nil
+	}
+
+	var version uint
+	var dirty bool
+	err = conn.QueryRow(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	if err != nil {
+		return 0, nil
+	}
+	if dirty {
+		return 0, fmt.Errorf("database is in a dirty state at version %d", version)
+	}
+	return version, nil
+}
+
+// DryRunSteps previews steps migrations (negative for down) against
+// connStr: the whole batch is executed inside a single transaction which
+// is then rolled back, so the schema is left untouched but each step sees
+// the effect of the ones before it, the same as a real run would. It logs
+// the same name/direction/duration fields a real run would.
+func DryRunSteps(connStr, migrationsDir string, steps int, log *logrus.Logger) error {
+	files, err := loadMigrationFiles(migrationsDir)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, connStr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	current, err := currentSchemaVersion(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	direction := "up"
+	if steps < 0 {
+		direction = "down"
+	}
+
+	n := steps
+	if n < 0 {
+		n = -n
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for i := 0; i < n; i++ {
+		var target *migrationFile
+		if direction == "up" {
+			for idx := range files {
+				if files[idx].version > current {
+					target = &files[idx]
+					break
+				}
+			}
+		} else {
+			for idx := len(files) - 1; idx >= 0; idx-- {
+				if files[idx].version <= current {
+					target = &files[idx]
+					break
+				}
+			}
+		}
+		if target == nil {
+			break
+		}
+
+		path := target.upPath
+		if direction == "down" {
+			path = strings.TrimSuffix(target.upPath, ".up.sql") + ".down.sql"
+		}
+
+		sql, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		start := time.Now()
+		_, execErr := tx.Exec(ctx, string(sql))
+		elapsed := time.Since(start)
+
+		if log != nil {
+			log.WithFields(logrus.Fields{
+				"name":      target.name,
+				"version":   target.version,
+				"direction": direction,
+				"duration":  elapsed,
+				"dry_run":   true,
+			}).Info("previewed migration")
+		}
+
+		if execErr != nil {
+			return execErr
+		}
+
+		if direction == "up" {
+			current = target.version
+		} else {
+			current = target.version - 1
+		}
+	}
+
+	return nil
+}
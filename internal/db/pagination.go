@@ -0,0 +1,133 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ListOpts configures GetComposesPage. Limit is required; Cursor, Since,
+// Until and ImageType are all optional.
+type ListOpts struct {
+	Limit int
+
+	// Cursor, when non-empty, resumes a previous GetComposesPage call from
+	// the point encoded in PageInfo.NextCursor.
+	Cursor string
+
+	// Since/Until bound the composes' created_at, when non-zero.
+	Since time.Time
+	Until time.Time
+
+	// ImageType, when non-empty, restricts results to composes whose
+	// request carries a matching "image_type" field.
+	ImageType string
+}
+
+// PageInfo describes a page of results returned by GetComposesPage.
+type PageInfo struct {
+	// NextCursor resumes from the end of this page; it's empty when
+	// there's no further page.
+	NextCursor string
+}
+
+type cursor struct {
+	createdAt time.Time
+	jobId     uuid.UUID
+}
+
+func encodeCursor(c cursor) string {
+	raw := fmt.Sprintf("%d:%s", c.createdAt.UnixNano(), c.jobId.String())
+	return base64.URLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(s string) (cursor, error) {
+	raw, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor{}, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return cursor{}, fmt.Errorf("invalid cursor: %q", s)
+	}
+
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return cursor{}, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	jobId, err := uuid.Parse(parts[1])
+	if err != nil {
+		return cursor{}, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	return cursor{createdAt: time.Unix(0, nanos), jobId: jobId}, nil
+}
+
+// GetComposesPage returns a keyset-paginated page of composes for orgID,
+// most recent first. Unlike GetComposes (OFFSET-based), pages don't shift
+// as new composes are inserted concurrently: pass the returned
+// PageInfo.NextCursor back in ListOpts.Cursor to fetch the next page.
+func (db *DB) GetComposesPage(orgID string, opts ListOpts) ([]ComposeEntry, PageInfo, error) {
+	if opts.Limit <= 0 {
+		return nil, PageInfo{}, fmt.Errorf("limit must be positive")
+	}
+
+	query := strings.Builder{}
+	query.WriteString("SELECT job_id, request, created_at, account_number, org_id FROM composes WHERE org_id = $1")
+	args := []interface{}{orgID}
+
+	if opts.Cursor != "" {
+		c, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return nil, PageInfo{}, err
+		}
+		args = append(args, c.createdAt, c.jobId)
+		query.WriteString(fmt.Sprintf(" AND (created_at, job_id) < ($%d, $%d)", len(args)-1, len(args)))
+	}
+
+	if !opts.Since.IsZero() {
+		args = append(args, opts.Since)
+		query.WriteString(fmt.Sprintf(" AND created_at >= $%d", len(args)))
+	}
+
+	if !opts.Until.IsZero() {
+		args = append(args, opts.Until)
+		query.WriteString(fmt.Sprintf(" AND created_at <= $%d", len(args)))
+	}
+
+	if opts.ImageType != "" {
+		args = append(args, opts.ImageType)
+		query.WriteString(fmt.Sprintf(" AND request->>'image_type' = $%d", len(args)))
+	}
+
+	// fetch one extra row to know whether a further page exists
+	args = append(args, opts.Limit+1)
+	query.WriteString(fmt.Sprintf(" ORDER BY created_at DESC, job_id DESC LIMIT $%d", len(args)))
+
+	rows, err := db.Pool.Query(context.Background(), query.String(), args...)
+	if err != nil {
+		return nil, PageInfo{}, err
+	}
+	defer rows.Close()
+
+	composes, err := scanComposes(rows)
+	if err != nil {
+		return nil, PageInfo{}, err
+	}
+
+	var page PageInfo
+	if len(composes) > opts.Limit {
+		last := composes[opts.Limit-1]
+		page.NextCursor = encodeCursor(cursor{createdAt: last.CreatedAt, jobId: last.Id})
+		composes = composes[:opts.Limit]
+	}
+
+	return composes, page, nil
+}
@@ -0,0 +1,33 @@
+// Package logger configures the structured logger shared by all
+// image-builder binaries.
+package logger
+
+import (
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+// NewLogger builds a logrus.Logger at the given level. splunkURL,
+// splunkToken and splunkSource configure an optional Splunk HEC hook; when
+// any of them is nil logging stays local. out overrides the logger's
+// output (primarily for tests); nil keeps the default of stderr.
+func NewLogger(level string, splunkURL, splunkToken, splunkSource *string, out io.Writer) (*logrus.Logger, error) {
+	log := logrus.New()
+
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	log.SetLevel(lvl)
+
+	if out != nil {
+		log.SetOutput(out)
+	}
+
+	if splunkURL != nil && splunkToken != nil && splunkSource != nil {
+		log.AddHook(newSplunkHook(*splunkURL, *splunkToken, *splunkSource))
+	}
+
+	return log, nil
+}
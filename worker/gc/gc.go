@@ -0,0 +1,83 @@
+// Package gc runs a background worker that enforces the configured
+// compose retention window, deleting composes older than it in batches.
+package gc
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+
+	"github.com/osbuild/image-builder/internal/db"
+)
+
+var (
+	composesDeleted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "image_builder_gc_composes_deleted_total",
+		Help: "Total number of composes deleted by the GC worker.",
+	})
+	batchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "image_builder_gc_batch_duration_seconds",
+		Help: "Duration of a single GC delete batch.",
+	})
+)
+
+// Worker periodically deletes composes older than Retention, in batches,
+// until the done channel passed to Run is closed.
+type Worker struct {
+	DB        *db.DB
+	Retention time.Duration
+	Interval  time.Duration
+	Log       *logrus.Logger
+}
+
+// Run blocks, sweeping every w.Interval, until done is closed.
+func (w *Worker) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			w.Sweep()
+		}
+	}
+}
+
+// Sweep deletes every compose older than w.Retention, one batch at a time.
+// It's exposed on its own so tests and operators can trigger a single
+// retention pass without waiting on the ticker.
+func (w *Worker) Sweep() {
+	if w.Retention <= 0 {
+		return
+	}
+
+	for {
+		start := time.Now()
+		deleted, err := w.DB.DeleteComposesOlderThan(w.Retention)
+		elapsed := time.Since(start)
+		batchDuration.Observe(elapsed.Seconds())
+
+		if err != nil {
+			if w.Log != nil {
+				w.Log.WithError(err).Error("gc: batch delete failed")
+			}
+			return
+		}
+
+		composesDeleted.Add(float64(deleted))
+		if w.Log != nil {
+			w.Log.WithFields(logrus.Fields{
+				"deleted":  deleted,
+				"duration": elapsed,
+			}).Info("gc: batch complete")
+		}
+
+		if deleted == 0 {
+			return
+		}
+	}
+}